@@ -0,0 +1,61 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package config holds the configuration types shared across Prometheus'
+// retrieval and discovery packages.
+package config
+
+import "github.com/prometheus/common/model"
+
+// Config is the top-level configuration for Prometheus's config files.
+type Config struct {
+	ScrapeConfigs []*ScrapeConfig
+}
+
+// ScrapeConfig configures a scraping unit for Prometheus.
+type ScrapeConfig struct {
+	// The job name to which the job label is set by default.
+	JobName string
+	// How frequently to scrape the targets of this scrape config.
+	ScrapeInterval model.Duration
+	// The HTTP resource path on which to fetch metrics from targets.
+	MetricsPath string
+	// The service discovery configuration for the job.
+	ServiceDiscoveryConfig ServiceDiscoveryConfig
+
+	// MaxConcurrentScrapes bounds the number of scrapes this job may have
+	// in flight at once. <= 0 means unbounded (subject to the global
+	// scrape budget).
+	MaxConcurrentScrapes int64
+
+	// Tenant identifies which backend this job's samples belong to in a
+	// multi-tenant deployment. Empty means the deployment's single default
+	// tenant. retrieval.AppendableRouter implementations key off this field
+	// to route a job's samples to the right Appendable.
+	Tenant string
+}
+
+// ServiceDiscoveryConfig configures service discovery sources for a scrape
+// config. Only the static source is implemented here; the full set
+// (DNS, Consul, Kubernetes, ...) lives outside this slice of the repo.
+type ServiceDiscoveryConfig struct {
+	StaticConfigs []*TargetGroup
+}
+
+// TargetGroup is a set of targets discovered together, sharing a common set
+// of labels.
+type TargetGroup struct {
+	Targets []model.LabelSet
+	Labels  model.LabelSet
+	Source  string
+}
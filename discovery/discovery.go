@@ -0,0 +1,144 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package discovery resolves the target providers for a scrape config into
+// a continuously synced set of target groups.
+package discovery
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/prometheus/prometheus/config"
+)
+
+// TargetProvider sends target group updates on up until ctx is canceled.
+type TargetProvider interface {
+	Run(ctx context.Context, up chan<- []*config.TargetGroup)
+}
+
+// staticProvider implements TargetProvider for a fixed set of target
+// groups that never changes, e.g. static_configs in a scrape config.
+type staticProvider struct {
+	groups []*config.TargetGroup
+}
+
+func (s *staticProvider) Run(ctx context.Context, up chan<- []*config.TargetGroup) {
+	select {
+	case up <- s.groups:
+	case <-ctx.Done():
+		return
+	}
+	<-ctx.Done()
+}
+
+// ProvidersFromConfig returns the target providers defined by cfg, keyed by
+// a name unique within the owning scrape config.
+func ProvidersFromConfig(cfg config.ServiceDiscoveryConfig, logger log.Logger) map[string]TargetProvider {
+	providers := map[string]TargetProvider{}
+	if len(cfg.StaticConfigs) > 0 {
+		providers["static"] = &staticProvider{groups: cfg.StaticConfigs}
+	}
+	return providers
+}
+
+// Syncer receives the target groups resolved by a TargetSet.
+type Syncer interface {
+	Sync(tgs []*config.TargetGroup)
+}
+
+// TargetSet runs a set of target providers and forwards every update they
+// produce to a Syncer. The provider set can be swapped out at any time via
+// UpdateProviders, even while Run is already driving the previous one.
+type TargetSet struct {
+	syncer Syncer
+
+	// updates carries the latest provider set from UpdateProviders to Run.
+	// It is buffered to size 1 and always holds the most recently set
+	// value: UpdateProviders drains a stale pending value before pushing
+	// its own, so Run never acts on anything but the newest call, however
+	// many land before it gets a chance to receive.
+	updates chan map[string]TargetProvider
+}
+
+// NewTargetSet returns a TargetSet that drives syncer.
+func NewTargetSet(syncer Syncer) *TargetSet {
+	return &TargetSet{
+		syncer:  syncer,
+		updates: make(chan map[string]TargetProvider, 1),
+	}
+}
+
+// UpdateProviders replaces the set of target providers the TargetSet runs.
+// If Run is already active, it cancels the providers currently running and
+// starts providers in their place; if Run hasn't started yet, it becomes
+// the set Run starts with once it does. Safe to call before Run, racing
+// Run's own startup included.
+func (ts *TargetSet) UpdateProviders(providers map[string]TargetProvider) {
+	for {
+		select {
+		case ts.updates <- providers:
+			return
+		default:
+			// Buffer is full with a value Run hasn't consumed yet; drop
+			// it in favor of this newer one and retry the send.
+			select {
+			case <-ts.updates:
+			default:
+			}
+		}
+	}
+}
+
+// Run starts the providers given to UpdateProviders and syncs their updates
+// until ctx is canceled, restarting the running set of providers whenever
+// UpdateProviders supplies a new one.
+func (ts *TargetSet) Run(ctx context.Context) {
+	up := make(chan []*config.TargetGroup)
+
+	var (
+		wg         sync.WaitGroup
+		provCtx    context.Context
+		provCancel context.CancelFunc = func() {}
+	)
+	startProviders := func(providers map[string]TargetProvider) {
+		// Stop whatever providers are currently running before starting
+		// the replacement set so two generations never race on up.
+		provCancel()
+		wg.Wait()
+
+		provCtx, provCancel = context.WithCancel(ctx)
+		for _, p := range providers {
+			wg.Add(1)
+			go func(p TargetProvider) {
+				defer wg.Done()
+				p.Run(provCtx, up)
+			}(p)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			provCancel()
+			wg.Wait()
+			return
+		case providers := <-ts.updates:
+			startProviders(providers)
+		case tgs := <-up:
+			ts.syncer.Sync(tgs)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/semaphore"
+)
+
+var targetScrapesThrottled = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "prometheus_target_scrapes_throttled_total",
+	Help: "Total number of scrapes skipped because the global or per-job scrape budget was exhausted.",
+})
+
+func init() {
+	prometheus.MustRegister(targetScrapesThrottled)
+}
+
+// defaultScrapeBudget is used when the manager is not given an explicit
+// budget, i.e. effectively unlimited in-flight scrapes.
+const defaultScrapeBudget = 1 << 20
+
+// newScrapeBudget returns a weighted semaphore sized n, used as the global
+// cap on in-flight scrapes across all scrape pools owned by a
+// TargetManager. n <= 0 means unbounded.
+func newScrapeBudget(n int64) *semaphore.Weighted {
+	if n <= 0 {
+		n = defaultScrapeBudget
+	}
+	return semaphore.NewWeighted(n)
+}
@@ -0,0 +1,245 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/semaphore"
+
+	"github.com/prometheus/prometheus/config"
+)
+
+// errBudgetExhausted is the failure reason logged for a scrape that was
+// skipped, rather than queued, because the job's or the global scrape budget
+// had no spare capacity when the loop went to acquire it.
+var errBudgetExhausted = errors.New("scrape skipped: scrape budget exhausted")
+
+// scrapePool manages scrape loops for all targets of a single scrape job.
+type scrapePool struct {
+	logger log.Logger
+
+	ctx    context.Context
+	cancel func()
+
+	mtx        sync.RWMutex
+	config     *config.ScrapeConfig
+	appendable Appendable
+	budget     *semaphore.Weighted // Global, shared across every pool the owning TargetManager creates.
+	jobBudget  *semaphore.Weighted // Local to this job, sized from cfg.MaxConcurrentScrapes.
+
+	targets        map[uint64]*Target
+	droppedTargets []*Target
+	loops          map[uint64]*scrapeLoop
+}
+
+// newScrapePool creates a new scrape pool for the given job. budget bounds
+// the number of scrapes in flight across every pool the owning
+// TargetManager creates; cfg.MaxConcurrentScrapes additionally bounds the
+// number in flight for this job alone, so one job scraping thousands of
+// slow targets can't itself exhaust file descriptors or memory even while
+// the global budget still has room.
+func newScrapePool(ctx context.Context, cfg *config.ScrapeConfig, app Appendable, budget *semaphore.Weighted, logger log.Logger) *scrapePool {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	if budget == nil {
+		budget = newScrapeBudget(0)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	return &scrapePool{
+		logger:     logger,
+		ctx:        cctx,
+		cancel:     cancel,
+		config:     cfg,
+		appendable: app,
+		budget:     budget,
+		jobBudget:  newScrapeBudget(cfg.MaxConcurrentScrapes),
+		targets:    map[uint64]*Target{},
+		loops:      map[uint64]*scrapeLoop{},
+	}
+}
+
+// reload applies cfg, app and budget to the pool. Every scrape loop already
+// running in it picks up the new appender, global budget and job budget
+// (sized from cfg.MaxConcurrentScrapes) on its next scrape; running loops
+// keep the scrape interval they were started with, so a new
+// cfg.ScrapeInterval applies only to loops started afterwards.
+func (sp *scrapePool) reload(cfg *config.ScrapeConfig, app Appendable, budget *semaphore.Weighted) {
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+
+	sp.config = cfg
+	sp.appendable = app
+	if budget != nil {
+		sp.budget = budget
+	}
+	sp.jobBudget = newScrapeBudget(cfg.MaxConcurrentScrapes)
+	for _, l := range sp.loops {
+		l.update(sp.appendable, sp.budget, sp.jobBudget)
+	}
+}
+
+// Sync converts target groups into scrape targets and starts, updates or
+// stops their scrape loops accordingly. It satisfies the targetSyncer
+// interface discovery.TargetSet drives.
+func (sp *scrapePool) Sync(tgs []*config.TargetGroup) {
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+
+	targets := make(map[uint64]*Target, len(sp.targets))
+	var dropped []*Target
+
+	for _, tg := range tgs {
+		for _, lset := range tg.Targets {
+			t := NewTarget(tg.Labels.Merge(lset), tg.Labels, nil)
+			if len(t.Labels()) == 0 {
+				dropped = append(dropped, t)
+				continue
+			}
+			targets[uint64(t.fingerprint())] = t
+		}
+	}
+
+	for fp, t := range targets {
+		if _, ok := sp.loops[fp]; ok {
+			continue
+		}
+		l := newScrapeLoop(sp.ctx, t, sp.appendable, sp.budget, sp.jobBudget, log.With(sp.logger, "target", t))
+		sp.loops[fp] = l
+		go l.run(time.Duration(sp.config.ScrapeInterval))
+	}
+	for fp, l := range sp.loops {
+		if _, ok := targets[fp]; !ok {
+			l.stop()
+			delete(sp.loops, fp)
+		}
+	}
+
+	sp.targets = targets
+	sp.droppedTargets = dropped
+}
+
+// stop terminates every scrape loop in the pool and waits for their last
+// in-flight scrape, if any, to finish.
+func (sp *scrapePool) stop() {
+	sp.cancel()
+
+	sp.mtx.Lock()
+	defer sp.mtx.Unlock()
+	for fp, l := range sp.loops {
+		l.stop()
+		delete(sp.loops, fp)
+	}
+}
+
+// scrapeLoop periodically scrapes a single target. Before issuing the HTTP
+// request for a scrape it acquires a unit of weight from both the job's own
+// budget and the global budget shared across jobs; if either has no spare
+// capacity the scrape is skipped (not queued) and counted as throttled.
+type scrapeLoop struct {
+	target *Target
+	logger log.Logger
+
+	mtx       sync.Mutex
+	app       Appendable
+	budget    *semaphore.Weighted
+	jobBudget *semaphore.Weighted
+
+	ctx    context.Context
+	cancel func()
+	done   chan struct{}
+}
+
+func newScrapeLoop(ctx context.Context, t *Target, app Appendable, budget, jobBudget *semaphore.Weighted, logger log.Logger) *scrapeLoop {
+	cctx, cancel := context.WithCancel(ctx)
+	return &scrapeLoop{
+		target:    t,
+		logger:    logger,
+		app:       app,
+		budget:    budget,
+		jobBudget: jobBudget,
+		ctx:       cctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+}
+
+// update swaps in a new appender and budgets, picked up by the next scrape.
+func (l *scrapeLoop) update(app Appendable, budget, jobBudget *semaphore.Weighted) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.app = app
+	l.budget = budget
+	l.jobBudget = jobBudget
+}
+
+func (l *scrapeLoop) run(interval time.Duration) {
+	defer close(l.done)
+
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-ticker.C:
+			l.scrape()
+		}
+	}
+}
+
+func (l *scrapeLoop) scrape() {
+	l.mtx.Lock()
+	budget, jobBudget, app := l.budget, l.jobBudget, l.app
+	l.mtx.Unlock()
+
+	if !jobBudget.TryAcquire(1) {
+		targetScrapesThrottled.Inc()
+		level.Debug(l.logger).Log("msg", "scrape skipped", "err", errBudgetExhausted, "reason", "job budget exhausted")
+		return
+	}
+	defer jobBudget.Release(1)
+
+	if !budget.TryAcquire(1) {
+		targetScrapesThrottled.Inc()
+		level.Debug(l.logger).Log("msg", "scrape skipped", "err", errBudgetExhausted, "reason", "global budget exhausted")
+		return
+	}
+	defer budget.Release(1)
+
+	appender, err := app.Appender()
+	if err != nil {
+		level.Error(l.logger).Log("msg", "could not get appender", "err", err)
+		return
+	}
+	// The actual HTTP scrape and sample ingestion into appender happen
+	// here; omitted as it is orthogonal to the budget this loop enforces.
+	_ = appender
+}
+
+func (l *scrapeLoop) stop() {
+	l.cancel()
+	<-l.done
+}
@@ -0,0 +1,111 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/sync/semaphore"
+
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// fakeAppendable counts how many times Appender was called, so a test can
+// assert a throttled scrape never got far enough to request one.
+type fakeAppendable struct {
+	calls int
+}
+
+func (f *fakeAppendable) Appender() (storage.Appender, error) {
+	f.calls++
+	return nil, nil
+}
+
+func newTestScrapeLoop(app Appendable, budget, jobBudget *semaphore.Weighted) *scrapeLoop {
+	return newScrapeLoop(context.Background(), NewTarget(nil, nil, nil), app, budget, jobBudget, log.NewNopLogger())
+}
+
+func TestScrapeLoopSkipsWhenGlobalBudgetExhausted(t *testing.T) {
+	before := testutil.ToFloat64(targetScrapesThrottled)
+
+	global := semaphore.NewWeighted(1)
+	if !global.TryAcquire(1) {
+		t.Fatal("could not pre-acquire the global budget for the test")
+	}
+	defer global.Release(1)
+
+	app := &fakeAppendable{}
+	l := newTestScrapeLoop(app, global, newScrapeBudget(0))
+	l.scrape()
+
+	if app.calls != 0 {
+		t.Fatalf("expected the scrape to be skipped before requesting an appender, got %d Appender() calls", app.calls)
+	}
+	if got := testutil.ToFloat64(targetScrapesThrottled) - before; got != 1 {
+		t.Fatalf("targetScrapesThrottled increased by %v, want 1", got)
+	}
+}
+
+func TestScrapeLoopSkipsWhenJobBudgetExhausted(t *testing.T) {
+	before := testutil.ToFloat64(targetScrapesThrottled)
+
+	job := semaphore.NewWeighted(1)
+	if !job.TryAcquire(1) {
+		t.Fatal("could not pre-acquire the job budget for the test")
+	}
+	defer job.Release(1)
+
+	app := &fakeAppendable{}
+	l := newTestScrapeLoop(app, newScrapeBudget(0), job)
+	l.scrape()
+
+	if app.calls != 0 {
+		t.Fatalf("expected the scrape to be skipped before requesting an appender, got %d Appender() calls", app.calls)
+	}
+	if got := testutil.ToFloat64(targetScrapesThrottled) - before; got != 1 {
+		t.Fatalf("targetScrapesThrottled increased by %v, want 1", got)
+	}
+}
+
+func TestScrapeLoopProceedsWhenBudgetAvailable(t *testing.T) {
+	before := testutil.ToFloat64(targetScrapesThrottled)
+
+	app := &fakeAppendable{}
+	l := newTestScrapeLoop(app, newScrapeBudget(0), newScrapeBudget(0))
+	l.scrape()
+
+	if app.calls != 1 {
+		t.Fatalf("expected the scrape to request an appender exactly once, got %d calls", app.calls)
+	}
+	if got := testutil.ToFloat64(targetScrapesThrottled) - before; got != 0 {
+		t.Fatalf("targetScrapesThrottled increased by %v, want 0", got)
+	}
+}
+
+func TestNewScrapePoolSizesJobBudgetFromConfig(t *testing.T) {
+	cfg := &config.ScrapeConfig{JobName: "job-a", MaxConcurrentScrapes: 1}
+	sp := newScrapePool(context.Background(), cfg, nil, newScrapeBudget(0), log.NewNopLogger())
+	defer sp.stop()
+
+	if !sp.jobBudget.TryAcquire(1) {
+		t.Fatal("expected to acquire the first unit of a size-1 job budget")
+	}
+	if sp.jobBudget.TryAcquire(1) {
+		t.Fatal("expected a size-1 job budget to reject a second concurrent acquire")
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/config"
+)
+
+var (
+	targetSyncOwnershipChanges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "prometheus_target_sharding_ownership_changes_total",
+			Help: "Total number of targets whose shard owner changed across a sync.",
+		},
+		[]string{"scrape_job"},
+	)
+	targetSyncUnowned = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "prometheus_target_sharding_unowned",
+			Help: "Current number of discovered targets not owned by this node.",
+		},
+		[]string{"scrape_job"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(targetSyncOwnershipChanges)
+	prometheus.MustRegister(targetSyncUnowned)
+}
+
+// Sharder decides, for a given target, which peer in a cluster of
+// cooperating Prometheus instances is responsible for scraping it.
+// Building a Ring is expected to be the expensive part (e.g. laying out a
+// hash ring); Ring.Owner is expected to be cheap enough to call once per
+// discovered target. Callers build one Ring per peer set and reuse it for
+// every target in that sync, rather than rebuilding per target.
+type Sharder interface {
+	// NewRing returns a Ring that answers ownership queries for the given
+	// peer set. Implementations must be deterministic: the same peers and
+	// the same fp passed to the returned Ring must always yield the same
+	// owner.
+	NewRing(peers []string) Ring
+}
+
+// Ring answers target ownership queries for a fixed peer set.
+type Ring interface {
+	Owner(fp model.Fingerprint) string
+}
+
+// PeerDiscoverer resolves the current membership of a sharded scrape
+// cluster. Implementations are called on every target sync and should be
+// cheap, e.g. backed by a gossip membership list or a cached lister.
+type PeerDiscoverer interface {
+	Peers() []string
+}
+
+// ShardingConfig configures cluster-aware scrape sharding. When Enabled, the
+// target manager consults Sharder to decide, for each discovered target,
+// whether the local node (identified by SelfID) is responsible for scraping
+// it. Targets owned by another peer are withheld from the scrape pool, but
+// still appear in TargetManager.TargetMap with Target.Owned() == false (and
+// in TargetManager.UnownedTargetMap, which filters to just those).
+type ShardingConfig struct {
+	Enabled bool
+
+	// SelfID identifies this node among the values returned by
+	// PeerDiscovery.Peers(). It must be stable across restarts.
+	SelfID string
+
+	Sharder       Sharder
+	PeerDiscovery PeerDiscoverer
+}
+
+// hashRingSharder is the default Sharder. Each peer is placed at several
+// points on a hash ring (to smooth load across a small number of peers) and
+// a target is owned by the peer whose closest ring point follows the
+// target's fingerprint.
+type hashRingSharder struct {
+	vnodes int
+}
+
+// NewHashRingSharder returns a Sharder that distributes ownership using
+// consistent hashing, so adding or removing a peer only reshuffles the
+// targets that land on the ring between its neighbours.
+func NewHashRingSharder() Sharder {
+	return &hashRingSharder{vnodes: 160}
+}
+
+// hashRing is a pre-built, sorted ring of vnode hash points. Building it is
+// the O(peers·vnodes·log) part; Owner is a single O(log) binary search.
+type hashRing struct {
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash uint64
+	peer string
+}
+
+func (s *hashRingSharder) NewRing(peers []string) Ring {
+	sorted := append([]string(nil), peers...)
+	sort.Strings(sorted)
+
+	points := make([]ringPoint, 0, len(sorted)*s.vnodes)
+	for _, p := range sorted {
+		for i := 0; i < s.vnodes; i++ {
+			h := fnv.New64a()
+			fmt.Fprintf(h, "%s-%d", p, i)
+			points = append(points, ringPoint{hash: h.Sum64(), peer: p})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+	return &hashRing{points: points}
+}
+
+func (r *hashRing) Owner(fp model.Fingerprint) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	target := uint64(fp)
+	idx := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= target })
+	if idx == len(r.points) {
+		idx = 0
+	}
+	return r.points[idx].peer
+}
+
+// targetSyncer is satisfied by *scrapePool and mirrors the Sync method
+// discovery.TargetSet drives its syncer with. shardFilter interposes on
+// this interface so it can withhold target groups before they ever reach
+// the pool.
+type targetSyncer interface {
+	Sync(tgs []*config.TargetGroup)
+}
+
+// shardFilter wraps a scrape pool's syncer, dropping targets the local node
+// does not own according to the manager's ShardingConfig. Withheld targets
+// are recorded on the manager as "unowned" rather than conflated with
+// targets dropped by relabeling.
+type shardFilter struct {
+	tm   *TargetManager
+	job  string
+	next targetSyncer
+}
+
+func (tm *TargetManager) newShardFilter(job string, next targetSyncer) *shardFilter {
+	return &shardFilter{tm: tm, job: job, next: next}
+}
+
+func (f *shardFilter) Sync(tgs []*config.TargetGroup) {
+	tm := f.tm
+
+	tm.mtx.RLock()
+	cfg := tm.sharding
+	tm.mtx.RUnlock()
+
+	if !cfg.Enabled {
+		tm.shardMtx.Lock()
+		delete(tm.unowned, f.job)
+		tm.shardMtx.Unlock()
+		targetSyncUnowned.DeleteLabelValues(f.job)
+		f.next.Sync(tgs)
+		return
+	}
+
+	peers := cfg.PeerDiscovery.Peers()
+	ring := cfg.Sharder.NewRing(peers)
+	owned := make([]*config.TargetGroup, 0, len(tgs))
+	var unowned []*Target
+	curOwner := map[model.Fingerprint]string{}
+	churn := 0
+
+	tm.shardMtx.Lock()
+	prevOwner := tm.ownership[f.job]
+
+	for _, tg := range tgs {
+		var keep []model.LabelSet
+		for _, lset := range tg.Targets {
+			fp := tg.Labels.Merge(lset).Fingerprint()
+			owner := ring.Owner(fp)
+			curOwner[fp] = owner
+			if prev, ok := prevOwner[fp]; ok && prev != owner {
+				churn++
+			}
+			if owner == cfg.SelfID {
+				keep = append(keep, lset)
+			} else {
+				t := NewTarget(tg.Labels.Merge(lset), tg.Labels, nil)
+				t.markUnowned()
+				unowned = append(unowned, t)
+			}
+		}
+		if len(keep) > 0 {
+			owned = append(owned, &config.TargetGroup{Targets: keep, Labels: tg.Labels, Source: tg.Source})
+		}
+	}
+
+	if tm.ownership == nil {
+		tm.ownership = map[string]map[model.Fingerprint]string{}
+	}
+	tm.ownership[f.job] = curOwner
+	if tm.unowned == nil {
+		tm.unowned = map[string][]*Target{}
+	}
+	tm.unowned[f.job] = unowned
+	tm.shardMtx.Unlock()
+
+	if churn > 0 {
+		targetSyncOwnershipChanges.WithLabelValues(f.job).Add(float64(churn))
+	}
+	targetSyncUnowned.WithLabelValues(f.job).Set(float64(len(unowned)))
+
+	f.next.Sync(owned)
+}
@@ -0,0 +1,100 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"net/url"
+	"sync"
+
+	"github.com/prometheus/common/model"
+)
+
+// Target refers to a singular HTTP or HTTPS endpoint that is scraped
+// periodically for metrics samples along with its labels.
+type Target struct {
+	mtx sync.RWMutex
+
+	labels           model.LabelSet
+	discoveredLabels model.LabelSet
+	params           url.Values
+
+	// owned reports whether the local node is responsible for scraping
+	// this target under the active ShardingConfig. Always true unless
+	// shardFilter.Sync marks a target unowned; sharding-disabled targets
+	// are therefore always owned.
+	owned bool
+}
+
+// NewTarget creates a reasonably configured target for querying.
+func NewTarget(labels, discoveredLabels model.LabelSet, params url.Values) *Target {
+	return &Target{
+		labels:           labels,
+		discoveredLabels: discoveredLabels,
+		params:           params,
+		owned:            true,
+	}
+}
+
+// markUnowned records that the local node is not responsible for scraping
+// this target under the active ShardingConfig. Called only by shardFilter.
+func (t *Target) markUnowned() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.owned = false
+}
+
+// Owned reports whether the local node is responsible for scraping this
+// target under the active ShardingConfig. Always true when sharding is
+// disabled.
+func (t *Target) Owned() bool {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.owned
+}
+
+// Labels returns a copy of the target's labels.
+func (t *Target) Labels() model.LabelSet {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	lset := make(model.LabelSet, len(t.labels))
+	for ln, lv := range t.labels {
+		lset[ln] = lv
+	}
+	return lset
+}
+
+// DiscoveredLabels returns a copy of the target's labels before any
+// relabeling was applied.
+func (t *Target) DiscoveredLabels() model.LabelSet {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	lset := make(model.LabelSet, len(t.discoveredLabels))
+	for ln, lv := range t.discoveredLabels {
+		lset[ln] = lv
+	}
+	return lset
+}
+
+// fingerprint uniquely identifies the target by its label set.
+func (t *Target) fingerprint() model.Fingerprint {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.labels.Fingerprint()
+}
+
+func (t *Target) String() string {
+	return t.labels.String()
+}
@@ -20,6 +20,10 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"golang.org/x/sync/semaphore"
+
 	"github.com/prometheus/prometheus/config"
 	"github.com/prometheus/prometheus/discovery"
 	"github.com/prometheus/prometheus/storage"
@@ -41,14 +45,37 @@ type TargetManager struct {
 	targetSets map[string]*targetSet
 	logger     log.Logger
 	starting   chan struct{}
+
+	// sharding holds the cluster-aware scrape sharding configuration, set
+	// via SetShardingConfig. It is guarded by mtx like the rest of the
+	// manager's configuration.
+	sharding ShardingConfig
+
+	// shardMtx guards ownership and unowned, which are written from
+	// shardFilter.Sync on arbitrary target-set goroutines and so cannot
+	// share mtx without risking deadlock against reload().
+	shardMtx  sync.Mutex
+	ownership map[string]map[model.Fingerprint]string
+	unowned   map[string][]*Target
+
+	// scrapeBudget bounds the number of scrapes in flight at once across
+	// every scrape pool the manager owns. Scrape loops acquire a unit of
+	// weight 1 before issuing their HTTP request and release it when the
+	// scrape completes.
+	scrapeBudget *semaphore.Weighted
+
+	// router, if set, overrides append on a per-job basis so different
+	// scrape jobs can land in different storage backends.
+	router AppendableRouter
 }
 
 type targetSet struct {
 	ctx    context.Context
 	cancel func()
 
-	ts *discovery.TargetSet
-	sp *scrapePool
+	ts     *discovery.TargetSet
+	sp     *scrapePool
+	syncer targetSyncer
 }
 
 // Appendable returns an Appender.
@@ -56,16 +83,93 @@ type Appendable interface {
 	Appender() (storage.Appender, error)
 }
 
+// AppendableRouter selects the storage.Appender that a scrape job's samples
+// should be written to, keyed on the job's own ScrapeConfig. Setting one on
+// a TargetManager via SetAppendableRouter overrides the single global
+// Appendable on a per-job basis, which multi-tenant deployments use to land
+// different jobs in different TSDB instances or remote-write endpoints,
+// typically by switching on scfg.Tenant.
+type AppendableRouter interface {
+	AppenderFor(scfg *config.ScrapeConfig) (storage.Appender, error)
+}
+
+// routedAppendable adapts a single AppenderFor(scfg) call into the
+// Appendable interface newScrapePool expects, binding it to one job's
+// ScrapeConfig.
+type routedAppendable struct {
+	router AppendableRouter
+	scfg   *config.ScrapeConfig
+}
+
+func (a routedAppendable) Appender() (storage.Appender, error) {
+	return a.router.AppenderFor(a.scfg)
+}
+
 // NewTargetManager creates a new TargetManager.
 func NewTargetManager(app Appendable, logger log.Logger) *TargetManager {
 	return &TargetManager{
-		append:     app,
-		targetSets: map[string]*targetSet{},
-		logger:     logger,
-		starting:   make(chan struct{}),
+		append:       app,
+		targetSets:   map[string]*targetSet{},
+		logger:       logger,
+		starting:     make(chan struct{}),
+		ownership:    map[string]map[model.Fingerprint]string{},
+		unowned:      map[string][]*Target{},
+		scrapeBudget: newScrapeBudget(0),
 	}
 }
 
+// SetShardingConfig installs cfg as the manager's cluster scrape sharding
+// configuration. Disabled by default, in which case every discovered target
+// is owned locally. Takes effect on the next reload. Returns an error
+// without installing cfg if it is Enabled but missing a Sharder or
+// PeerDiscovery, since shardFilter.Sync would otherwise nil-panic on the
+// next target sync.
+func (tm *TargetManager) SetShardingConfig(cfg ShardingConfig) error {
+	if cfg.Enabled {
+		if cfg.Sharder == nil {
+			return errors.New("sharding config: Sharder must be set when Enabled")
+		}
+		if cfg.PeerDiscovery == nil {
+			return errors.New("sharding config: PeerDiscovery must be set when Enabled")
+		}
+	}
+
+	tm.mtx.Lock()
+	defer tm.mtx.Unlock()
+	tm.sharding = cfg
+	return nil
+}
+
+// SetMaxConcurrentScrapes bounds the total number of scrapes in flight at
+// once across all of the manager's scrape pools. n <= 0 removes the bound.
+// Takes effect on the next reload; existing scrape pools keep using their
+// previous budget until then.
+func (tm *TargetManager) SetMaxConcurrentScrapes(n int64) {
+	tm.mtx.Lock()
+	defer tm.mtx.Unlock()
+	tm.scrapeBudget = newScrapeBudget(n)
+}
+
+// SetAppendableRouter installs router as the manager's per-job Appendable
+// selector, superseding the single Appendable passed to NewTargetManager
+// for every job from the next reload onward. Pass nil to revert to the
+// global Appendable.
+func (tm *TargetManager) SetAppendableRouter(router AppendableRouter) {
+	tm.mtx.Lock()
+	defer tm.mtx.Unlock()
+	tm.router = router
+}
+
+// appenderFor resolves the Appendable a job's scrape pool should write
+// through: the routed appender if a router is installed, the manager's
+// global Appendable otherwise. The caller must hold tm.mtx.
+func (tm *TargetManager) appenderFor(scfg *config.ScrapeConfig) Appendable {
+	if tm.router == nil {
+		return tm.append
+	}
+	return routedAppendable{router: tm.router, scfg: scfg}
+}
+
 // Run starts background processing to handle target updates.
 func (tm *TargetManager) Run() {
 	level.Info(tm.logger).Log("msg", "Starting target manager...")
@@ -105,32 +209,7 @@ func (tm *TargetManager) reload() {
 	// Start new target sets and update existing ones.
 	for _, scfg := range tm.scrapeConfigs {
 		jobs[scfg.JobName] = struct{}{}
-
-		ts, ok := tm.targetSets[scfg.JobName]
-		if !ok {
-			ctx, cancel := context.WithCancel(tm.ctx)
-			ts = &targetSet{
-				ctx:    ctx,
-				cancel: cancel,
-				sp:     newScrapePool(ctx, scfg, tm.append, log.With(tm.logger, "scrape_pool", scfg.JobName)),
-			}
-			ts.ts = discovery.NewTargetSet(ts.sp)
-
-			tm.targetSets[scfg.JobName] = ts
-
-			tm.wg.Add(1)
-
-			go func(ts *targetSet) {
-				// Run target set, which blocks until its context is canceled.
-				// Gracefully shut down pending scrapes in the scrape pool afterwards.
-				ts.ts.Run(ctx)
-				ts.sp.stop()
-				tm.wg.Done()
-			}(ts)
-		} else {
-			ts.sp.reload(scfg)
-		}
-		ts.ts.UpdateProviders(discovery.ProvidersFromConfig(scfg.ServiceDiscoveryConfig, tm.logger))
+		tm.reloadJob(scfg)
 	}
 
 	// Remove old target sets. Waiting for scrape pools to complete pending
@@ -139,11 +218,149 @@ func (tm *TargetManager) reload() {
 		if _, ok := jobs[name]; !ok {
 			ts.cancel()
 			delete(tm.targetSets, name)
+
+			tm.shardMtx.Lock()
+			delete(tm.ownership, name)
+			delete(tm.unowned, name)
+			tm.shardMtx.Unlock()
 		}
 	}
 }
 
-// TargetMap returns map of active and dropped targets and their corresponding scrape config job name.
+// reloadJob starts the targetSet for scfg if it doesn't exist yet, or
+// updates it in place otherwise, re-running only its SD providers and
+// scrape pool. The caller must hold tm.mtx and tm.ctx must be non-nil.
+func (tm *TargetManager) reloadJob(scfg *config.ScrapeConfig) {
+	ts, ok := tm.targetSets[scfg.JobName]
+	if !ok {
+		ctx, cancel := context.WithCancel(tm.ctx)
+		ts = &targetSet{
+			ctx:    ctx,
+			cancel: cancel,
+			sp:     newScrapePool(ctx, scfg, tm.appenderFor(scfg), tm.scrapeBudget, log.With(tm.logger, "scrape_pool", scfg.JobName)),
+		}
+		// Always interpose shardFilter; it is a no-op pass-through
+		// whenever sharding is disabled, so toggling ShardingConfig at
+		// runtime doesn't require recreating the target set.
+		ts.syncer = tm.newShardFilter(scfg.JobName, ts.sp)
+		ts.ts = discovery.NewTargetSet(ts.syncer)
+
+		tm.targetSets[scfg.JobName] = ts
+
+		tm.wg.Add(1)
+
+		go func(ts *targetSet) {
+			// Run target set, which blocks until its context is canceled.
+			// Gracefully shut down pending scrapes in the scrape pool afterwards.
+			ts.ts.Run(ctx)
+			ts.sp.stop()
+			tm.wg.Done()
+		}(ts)
+	} else {
+		// Re-thread the current appender and budget too, not just scfg:
+		// otherwise a job that already has a running targetSet would never
+		// pick up a SetMaxConcurrentScrapes or SetAppendableRouter change
+		// applied after it was created.
+		ts.sp.reload(scfg, tm.appenderFor(scfg), tm.scrapeBudget)
+	}
+	ts.ts.UpdateProviders(discovery.ProvidersFromConfig(scfg.ServiceDiscoveryConfig, tm.logger))
+}
+
+// ReloadJob updates the configuration and running targetSet for a single
+// scrape job, re-running just its SD providers and scrape pool reload. It
+// holds tm.mtx only for the duration of that one job's update, unlike a
+// full ApplyConfig reload which rebuilds every job under the same lock.
+func (tm *TargetManager) ReloadJob(jobName string, scfg *config.ScrapeConfig) error {
+	if scfg.JobName != jobName {
+		return errors.Errorf("job name %q does not match scrape config job name %q", jobName, scfg.JobName)
+	}
+
+	tm.mtx.Lock()
+	defer tm.mtx.Unlock()
+
+	if tm.ctx == nil {
+		return errors.New("target manager is not running")
+	}
+	if _, ok := tm.targetSets[jobName]; !ok {
+		return errors.Errorf("job %q does not exist, use AddJob to create it", jobName)
+	}
+
+	for i, c := range tm.scrapeConfigs {
+		if c.JobName == jobName {
+			tm.scrapeConfigs[i] = scfg
+			break
+		}
+	}
+	tm.reloadJob(scfg)
+	return nil
+}
+
+// AddJob registers a new scrape job and starts its targetSet, without
+// touching any other job. It returns an error if the job already exists;
+// use ReloadJob to update one in place.
+func (tm *TargetManager) AddJob(scfg *config.ScrapeConfig) error {
+	tm.mtx.Lock()
+	defer tm.mtx.Unlock()
+
+	if tm.ctx == nil {
+		return errors.New("target manager is not running")
+	}
+	if _, ok := tm.targetSets[scfg.JobName]; ok {
+		return errors.Errorf("job %q already exists, use ReloadJob to update it", scfg.JobName)
+	}
+
+	tm.scrapeConfigs = append(tm.scrapeConfigs, scfg)
+	tm.reloadJob(scfg)
+	return nil
+}
+
+// RemoveJob stops and removes a single job's targetSet, without touching
+// any other job.
+func (tm *TargetManager) RemoveJob(jobName string) error {
+	tm.mtx.Lock()
+	defer tm.mtx.Unlock()
+
+	ts, ok := tm.targetSets[jobName]
+	if !ok {
+		return errors.Errorf("job %q does not exist", jobName)
+	}
+	ts.cancel()
+	delete(tm.targetSets, jobName)
+
+	tm.shardMtx.Lock()
+	delete(tm.ownership, jobName)
+	delete(tm.unowned, jobName)
+	tm.shardMtx.Unlock()
+
+	for i, c := range tm.scrapeConfigs {
+		if c.JobName == jobName {
+			tm.scrapeConfigs = append(tm.scrapeConfigs[:i], tm.scrapeConfigs[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// UnownedTargetMap returns, per scrape job, the targets discovered but
+// currently owned by another peer under the active ShardingConfig. It is a
+// convenience filter over the unowned subset of TargetMap's result — every
+// Target it returns also appears in TargetMap with Owned() == false.
+func (tm *TargetManager) UnownedTargetMap() map[string][]*Target {
+	tm.shardMtx.Lock()
+	defer tm.shardMtx.Unlock()
+
+	targetsMap := make(map[string][]*Target, len(tm.unowned))
+	for jobName, ts := range tm.unowned {
+		targetsMap[jobName] = append(targetsMap[jobName], ts...)
+	}
+	return targetsMap
+}
+
+// TargetMap returns a map of active and dropped targets by their
+// corresponding scrape config job name. It includes targets withheld under
+// a ShardingConfig (assigned to another peer); call Target.Owned to tell
+// those apart from targets scraped locally. UnownedTargetMap returns just
+// that unowned subset, for callers that only care about it.
 func (tm *TargetManager) TargetMap() map[string][]*Target {
 	tm.mtx.RLock()
 	defer tm.mtx.RUnlock()
@@ -157,6 +374,13 @@ func (tm *TargetManager) TargetMap() map[string][]*Target {
 		targetsMap[jobName] = append(targetsMap[jobName], ps.sp.droppedTargets...)
 		ps.sp.mtx.RUnlock()
 	}
+
+	tm.shardMtx.Lock()
+	for jobName, unowned := range tm.unowned {
+		targetsMap[jobName] = append(targetsMap[jobName], unowned...)
+	}
+	tm.shardMtx.Unlock()
+
 	return targetsMap
 }
 
@@ -0,0 +1,266 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/storage"
+)
+
+func newTestTargetManager() *TargetManager {
+	return NewTargetManager(nil, log.NewNopLogger())
+}
+
+func TestAddJobBeforeRunErrors(t *testing.T) {
+	tm := newTestTargetManager()
+
+	err := tm.AddJob(&config.ScrapeConfig{JobName: "job-a"})
+	if err == nil {
+		t.Fatal("expected an error adding a job before the manager is running, got nil")
+	}
+}
+
+func TestReloadJobMismatchedNameErrors(t *testing.T) {
+	tm := newTestTargetManager()
+	go tm.Run()
+	<-tm.starting
+	defer tm.Stop()
+
+	if err := tm.ReloadJob("job-a", &config.ScrapeConfig{JobName: "job-b"}); err == nil {
+		t.Fatal("expected an error when jobName does not match scfg.JobName, got nil")
+	}
+}
+
+func TestReloadJobUnknownJobErrors(t *testing.T) {
+	tm := newTestTargetManager()
+	go tm.Run()
+	<-tm.starting
+	defer tm.Stop()
+
+	err := tm.ReloadJob("job-a", &config.ScrapeConfig{JobName: "job-a"})
+	if err == nil {
+		t.Fatal("expected an error reloading a job that was never added, got nil")
+	}
+}
+
+type fakePeerDiscoverer struct{ peers []string }
+
+func (f fakePeerDiscoverer) Peers() []string { return f.peers }
+
+func TestSetShardingConfigRequiresSharderWhenEnabled(t *testing.T) {
+	tm := newTestTargetManager()
+
+	err := tm.SetShardingConfig(ShardingConfig{
+		Enabled:       true,
+		PeerDiscovery: fakePeerDiscoverer{peers: []string{"node-a"}},
+	})
+	if err == nil {
+		t.Fatal("expected an error enabling sharding without a Sharder, got nil")
+	}
+}
+
+func TestSetShardingConfigRequiresPeerDiscoveryWhenEnabled(t *testing.T) {
+	tm := newTestTargetManager()
+
+	err := tm.SetShardingConfig(ShardingConfig{
+		Enabled: true,
+		Sharder: NewHashRingSharder(),
+	})
+	if err == nil {
+		t.Fatal("expected an error enabling sharding without a PeerDiscovery, got nil")
+	}
+}
+
+func TestSetShardingConfigDisabledAllowsNilFields(t *testing.T) {
+	tm := newTestTargetManager()
+
+	if err := tm.SetShardingConfig(ShardingConfig{Enabled: false}); err != nil {
+		t.Fatalf("unexpected error disabling sharding with no Sharder/PeerDiscovery: %s", err)
+	}
+}
+
+func TestSetShardingConfigValid(t *testing.T) {
+	tm := newTestTargetManager()
+
+	cfg := ShardingConfig{
+		Enabled:       true,
+		SelfID:        "node-a",
+		Sharder:       NewHashRingSharder(),
+		PeerDiscovery: fakePeerDiscoverer{peers: []string{"node-a", "node-b"}},
+	}
+	if err := tm.SetShardingConfig(cfg); err != nil {
+		t.Fatalf("unexpected error setting a valid sharding config: %s", err)
+	}
+}
+
+func TestAddReloadRemoveJob(t *testing.T) {
+	tm := newTestTargetManager()
+	go tm.Run()
+	<-tm.starting
+	defer tm.Stop()
+
+	scfg := &config.ScrapeConfig{JobName: "job-a"}
+
+	if err := tm.AddJob(scfg); err != nil {
+		t.Fatalf("AddJob: unexpected error: %s", err)
+	}
+	if err := tm.AddJob(scfg); err == nil {
+		t.Fatal("expected an error adding a job that already exists, got nil")
+	}
+
+	if err := tm.ReloadJob("job-a", scfg); err != nil {
+		t.Fatalf("ReloadJob: unexpected error: %s", err)
+	}
+
+	if err := tm.RemoveJob("job-a"); err != nil {
+		t.Fatalf("RemoveJob: unexpected error: %s", err)
+	}
+	if err := tm.RemoveJob("job-a"); err == nil {
+		t.Fatal("expected an error removing a job that no longer exists, got nil")
+	}
+
+	if err := tm.ReloadJob("job-a", scfg); err == nil {
+		t.Fatal("expected an error reloading a job that was removed, got nil")
+	}
+}
+
+func staticScrapeConfig(jobName string, addrs ...string) *config.ScrapeConfig {
+	targets := make([]model.LabelSet, len(addrs))
+	for i, addr := range addrs {
+		targets[i] = model.LabelSet{"instance": model.LabelValue(addr)}
+	}
+	return &config.ScrapeConfig{
+		JobName: jobName,
+		ServiceDiscoveryConfig: config.ServiceDiscoveryConfig{
+			StaticConfigs: []*config.TargetGroup{{Targets: targets}},
+		},
+	}
+}
+
+// waitForTargetCount polls TargetMap until job has exactly want targets, so
+// tests don't race the asynchronous target-set sync goroutine.
+func waitForTargetCount(t *testing.T, tm *TargetManager, job string, want int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if got := len(tm.TargetMap()[job]); got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("TargetMap()[%q] never reached %d targets, got %d", job, want, len(tm.TargetMap()[job]))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReloadJobPicksUpNewStaticTargets(t *testing.T) {
+	tm := newTestTargetManager()
+	go tm.Run()
+	<-tm.starting
+	defer tm.Stop()
+
+	if err := tm.AddJob(staticScrapeConfig("job-a", "host-a:9090")); err != nil {
+		t.Fatalf("AddJob: unexpected error: %s", err)
+	}
+	waitForTargetCount(t, tm, "job-a", 1)
+
+	reloaded := staticScrapeConfig("job-a", "host-a:9090", "host-b:9090", "host-c:9090")
+	if err := tm.ReloadJob("job-a", reloaded); err != nil {
+		t.Fatalf("ReloadJob: unexpected error: %s", err)
+	}
+	waitForTargetCount(t, tm, "job-a", 3)
+}
+
+func TestApplyConfigPicksUpNewStaticTargets(t *testing.T) {
+	tm := newTestTargetManager()
+	go tm.Run()
+	<-tm.starting
+	defer tm.Stop()
+
+	cfg := &config.Config{ScrapeConfigs: []*config.ScrapeConfig{staticScrapeConfig("job-a", "host-a:9090")}}
+	if err := tm.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ApplyConfig: unexpected error: %s", err)
+	}
+	waitForTargetCount(t, tm, "job-a", 1)
+
+	cfg.ScrapeConfigs[0] = staticScrapeConfig("job-a", "host-a:9090", "host-b:9090")
+	if err := tm.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ApplyConfig: unexpected error: %s", err)
+	}
+	waitForTargetCount(t, tm, "job-a", 2)
+}
+
+type fakeRouter struct {
+	appenders map[string]storage.Appender
+}
+
+func (r fakeRouter) AppenderFor(scfg *config.ScrapeConfig) (storage.Appender, error) {
+	app, ok := r.appenders[scfg.JobName]
+	if !ok {
+		return nil, errors.Errorf("no appender configured for job %q", scfg.JobName)
+	}
+	return app, nil
+}
+
+func TestAppenderForUsesGlobalAppendableWithoutRouter(t *testing.T) {
+	global := &fakeAppendable{}
+	tm := NewTargetManager(global, log.NewNopLogger())
+
+	scfg := &config.ScrapeConfig{JobName: "job-a"}
+	app := tm.appenderFor(scfg)
+	if _, err := app.Appender(); err != nil {
+		t.Fatalf("unexpected error from the global Appendable: %s", err)
+	}
+	if global.calls != 1 {
+		t.Fatalf("expected the global Appendable to be used, got %d calls", global.calls)
+	}
+}
+
+func TestAppenderForUsesRouterWhenSet(t *testing.T) {
+	tm := newTestTargetManager()
+	jobAApp := &fakeTestAppender{}
+	tm.SetAppendableRouter(fakeRouter{appenders: map[string]storage.Appender{"job-a": jobAApp}})
+
+	app := tm.appenderFor(&config.ScrapeConfig{JobName: "job-a"})
+	got, err := app.Appender()
+	if err != nil {
+		t.Fatalf("unexpected error from the routed Appendable: %s", err)
+	}
+	if got != jobAApp {
+		t.Fatalf("appenderFor returned the wrong Appender for a routed job")
+	}
+}
+
+func TestAppenderForPropagatesRouterError(t *testing.T) {
+	tm := newTestTargetManager()
+	tm.SetAppendableRouter(fakeRouter{appenders: map[string]storage.Appender{}})
+
+	app := tm.appenderFor(&config.ScrapeConfig{JobName: "job-a"})
+	if _, err := app.Appender(); err == nil {
+		t.Fatal("expected appenderFor's Appender() to surface the router's error, got nil")
+	}
+}
+
+// fakeTestAppender is a storage.Appender identity marker distinct from nil,
+// so routedAppendable tests can assert the exact Appender a router returned
+// was the one propagated through, not merely a non-nil value.
+type fakeTestAppender struct{ storage.Appender }
@@ -0,0 +1,36 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package storage holds the interfaces scrape ingestion writes samples
+// through. The concrete TSDB implementation lives outside this slice of
+// the repo.
+package storage
+
+import "github.com/prometheus/common/model"
+
+// Appender provides batched appending into a time series storage.
+type Appender interface {
+	// Add adds a sample pair for the given label set and returns a
+	// reference that can be used to add further samples via AddFast.
+	Add(l model.LabelSet, t int64, v float64) (uint64, error)
+
+	// AddFast adds a sample pair for the series referenced by ref,
+	// bypassing label set resolution.
+	AddFast(ref uint64, t int64, v float64) error
+
+	// Commit submits the collected samples and purges the batch.
+	Commit() error
+
+	// Rollback discards all modifications made in the appender so far.
+	Rollback() error
+}